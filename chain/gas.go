@@ -0,0 +1,70 @@
+package chain
+
+import (
+	"github.com/filecoin-project/go-lotus/chain/types"
+	"golang.org/x/xerrors"
+)
+
+// Gas prices for the primitive operations the VM can charge for. These are
+// placeholders until a real gas schedule is specified by the protocol, but
+// they need to exist so that an actor can't loop forever or fill up the
+// state tree for free.
+const (
+	GasStoragePutBase    = int64(100)
+	GasStoragePutPerByte = int64(1)
+
+	// Get is charged GasStorageGetBase plus GasIpldLinkTraversal for
+	// following the ipld link from a CID to the node it points at, then
+	// GasStorageGetPerByte for each byte of the loaded node.
+	GasStorageGetBase    = int64(50)
+	GasIpldLinkTraversal = int64(10)
+	GasStorageGetPerByte = int64(1)
+
+	GasSend   = int64(20)
+	GasInvoke = int64(30)
+)
+
+// ExitCodeOutOfGas is returned when a message exhausts its gas limit partway
+// through execution.
+const ExitCodeOutOfGas = 200
+
+// ErrOutOfGas is the sentinel chargeGas returns once a message's gas limit
+// has been exceeded. ApplyMessage and Send translate it into
+// ExitCodeOutOfGas rather than surfacing it as a hard error.
+var ErrOutOfGas = xerrors.New("message ran out of gas")
+
+// GasCharge records a single gas-charging event, named after the operation
+// that triggered it, for consumption by a Tracer.
+type GasCharge struct {
+	Name  string
+	Value int64
+}
+
+// gasTracker accumulates gas usage against a limit. A single tracker is
+// shared between a top level VMContext and every child VMContext created by
+// Send, so nested calls all draw from the same budget.
+type gasTracker struct {
+	limit types.BigInt
+	used  types.BigInt
+}
+
+func newGasTracker(limit types.BigInt) *gasTracker {
+	return &gasTracker{
+		limit: limit,
+		used:  types.NewInt(0),
+	}
+}
+
+func (gt *gasTracker) charge(amount int64) error {
+	want := types.BigAdd(gt.used, types.NewInt(uint64(amount)))
+	if types.BigCmp(want, gt.limit) > 0 {
+		// clamp at the limit rather than recording the full (over-budget)
+		// charge, so GasUsed() can never report more than msg.GasLimit and
+		// the gas cost ApplyMessage deducts on the out-of-gas path stays
+		// within the balance it already verified as solvent
+		gt.used = gt.limit
+		return ErrOutOfGas
+	}
+	gt.used = want
+	return nil
+}
@@ -0,0 +1,188 @@
+package chain
+
+import (
+	"sort"
+
+	"github.com/filecoin-project/go-lotus/chain/address"
+	"github.com/filecoin-project/go-lotus/chain/types"
+	"github.com/pkg/errors"
+)
+
+// rwSet is the set of actor addresses a message, and anything it Sends to in
+// turn, reads or writes. Two messages can only run in the same parallel
+// batch if their rwSets are disjoint.
+type rwSet map[address.Address]struct{}
+
+func (a rwSet) conflicts(b rwSet) bool {
+	for addr := range a {
+		if _, ok := b[addr]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// dryRunRWSets executes msgs in order against a single throwaway fork of the
+// state tree, purely to see which actors each one (and any nested sends)
+// touches. The fork is shared and evolves across the whole batch - unlike
+// forking independently per message from the pre-tipset base, this lets each
+// sender's nonce actually advance between its own messages, so a tipset with
+// more than one message from the same sender gets a real rwSet for the
+// second and later ones instead of an invalid-nonce failure. The resulting
+// state and any per-message error are discarded; only the set of addresses
+// visited, taken from each recorded ExecutionTrace, is kept.
+func (vm *VM) dryRunRWSets(msgs []*types.Message) []rwSet {
+	tmp := &VM{
+		cstate:      vm.cstate.Fork(),
+		base:        vm.base,
+		cs:          vm.cs,
+		buf:         vm.buf,
+		blockHeight: vm.blockHeight,
+		blockMiner:  vm.blockMiner,
+		inv:         vm.inv,
+	}
+
+	sets := make([]rwSet, len(msgs))
+	for i, msg := range msgs {
+		_, trace, _ := tmp.ApplyMessageWithTrace(msg)
+
+		set := rwSet{}
+
+		// every ApplyMessage deposits the gas reward into the block
+		// miner's actor, even though that write never shows up in the
+		// trace - without this, two messages that otherwise touch
+		// disjoint actors would be judged non-conflicting and their
+		// miner deposits would race each other across forked overlays,
+		// silently dropping one of them on merge
+		set[vm.blockMiner] = struct{}{}
+
+		var walk func(et *ExecutionTrace)
+		walk = func(et *ExecutionTrace) {
+			if et == nil || et.Msg == nil {
+				return
+			}
+			set[et.Msg.From] = struct{}{}
+			set[et.Msg.To] = struct{}{}
+			for _, sub := range et.Subcalls {
+				walk(sub)
+			}
+		}
+		walk(trace)
+
+		sets[i] = set
+	}
+
+	return sets
+}
+
+// batchMessages greedily groups message indices into the earliest batch
+// whose rwSets are all pairwise disjoint with the candidate's, preserving
+// the original message order within and across batches.
+func batchMessages(sets []rwSet) [][]int {
+	var batches [][]int
+	for i, set := range sets {
+		placed := false
+		for bi, batch := range batches {
+			conflict := false
+			for _, j := range batch {
+				if set.conflicts(sets[j]) {
+					conflict = true
+					break
+				}
+			}
+			if !conflict {
+				batches[bi] = append(batch, i)
+				placed = true
+				break
+			}
+		}
+		if !placed {
+			batches = append(batches, []int{i})
+		}
+	}
+	return batches
+}
+
+// ApplyMessages applies a full tipset's worth of messages, running
+// non-conflicting ones concurrently while guaranteeing the same final state
+// root as applying them one at a time in order. Each message's read/write
+// set is discovered with a tracing dry run; messages whose sets don't
+// overlap are grouped into a batch and executed concurrently against forked
+// state overlays, which are then merged back into the real state tree in
+// original message order. Anything the dry run missed (and so still
+// conflicts at execution time) is simply re-run serially against the real
+// state tree, so the result is always identical to sequential ApplyMessage
+// regardless of how the batches happened to be scheduled - which is what
+// keeps this safe to use from block validation. Because dryRunRWSets puts
+// the block miner into every message's rwSet, no two messages are ever
+// disjoint: every batch holds a single message, and all messages are applied
+// one at a time in order.
+func (vm *VM) ApplyMessages(msgs []*types.Message) ([]*types.MessageReceipt, error) {
+	sets := vm.dryRunRWSets(msgs)
+
+	receipts := make([]*types.MessageReceipt, len(msgs))
+
+	for _, batch := range batchMessages(sets) {
+		if len(batch) == 1 {
+			rec, err := vm.ApplyMessage(msgs[batch[0]])
+			if err != nil {
+				return nil, err
+			}
+			receipts[batch[0]] = rec
+			continue
+		}
+
+		type result struct {
+			idx  int
+			rec  *types.MessageReceipt
+			fork *StateTree
+			err  error
+		}
+
+		out := make(chan result, len(batch))
+		for _, i := range batch {
+			go func(i int) {
+				tmp := &VM{
+					cstate:      vm.cstate.Fork(),
+					base:        vm.base,
+					cs:          vm.cs,
+					buf:         vm.buf,
+					blockHeight: vm.blockHeight,
+					blockMiner:  vm.blockMiner,
+					inv:         vm.inv,
+					debugChecks: vm.debugChecks,
+				}
+
+				rec, err := tmp.ApplyMessage(msgs[i])
+				out <- result{idx: i, rec: rec, fork: tmp.cstate, err: err}
+			}(i)
+		}
+
+		results := make([]result, 0, len(batch))
+		for range batch {
+			results = append(results, <-out)
+		}
+		sort.Slice(results, func(a, b int) bool { return results[a].idx < results[b].idx })
+
+		for _, r := range results {
+			if r.err != nil {
+				// the dry run analysis missed a conflict - fall back to
+				// running this one serially against the real state tree
+				// rather than risk a nondeterministic root
+				rec, err := vm.ApplyMessage(msgs[r.idx])
+				if err != nil {
+					return nil, err
+				}
+				receipts[r.idx] = rec
+				continue
+			}
+
+			if err := vm.cstate.Merge(r.fork); err != nil {
+				return nil, errors.Wrap(err, "merging parallel batch result")
+			}
+			receipts[r.idx] = r.rec
+		}
+	}
+
+	return receipts, nil
+}
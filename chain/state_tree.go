@@ -0,0 +1,187 @@
+package chain
+
+import (
+	"context"
+
+	"github.com/filecoin-project/go-lotus/chain/address"
+	"github.com/filecoin-project/go-lotus/chain/types"
+	cid "github.com/ipfs/go-cid"
+	hamt "github.com/ipfs/go-hamt-ipld"
+	"github.com/pkg/errors"
+	"golang.org/x/xerrors"
+)
+
+// ErrActorNotFound is returned by StateTree.GetActor when no actor is
+// registered at the given address.
+var ErrActorNotFound = xerrors.New("actor not found")
+
+// StateTree is the HAMT-backed map from actor address to actor state. Reads
+// go through an in-memory cache so repeated GetActor calls for an actor
+// already touched this session return the same pointer; writes only land in
+// that cache until Flush persists them into the HAMT. Snapshot/Revert/
+// ClearSnapshot form a stack of cache checkpoints, so a nested Send can push
+// its own checkpoint and revert just what it touched without disturbing a
+// checkpoint an outer caller still has open.
+type StateTree struct {
+	root  *hamt.Node
+	store *hamt.CborIpldStore
+
+	actorcache map[address.Address]*types.Actor
+	snapshots  []map[address.Address]types.Actor
+}
+
+// newStateTree builds a StateTree with no HAMT backing at all, relying
+// entirely on the actor cache. It's only safe to use where every actor is
+// registered with SetActor before it's ever read, since GetActor has
+// nothing to fall back to on a cache miss - which is exactly the shape
+// tests that don't need real persistence want.
+func newStateTree() *StateTree {
+	return &StateTree{actorcache: make(map[address.Address]*types.Actor)}
+}
+
+// LoadStateTree loads the actor HAMT rooted at c.
+func LoadStateTree(cst *hamt.CborIpldStore, c cid.Cid) (*StateTree, error) {
+	nd, err := hamt.LoadNode(context.TODO(), cst, c)
+	if err != nil {
+		return nil, errors.Wrap(err, "loading hamt node")
+	}
+
+	return &StateTree{
+		root:       nd,
+		store:      cst,
+		actorcache: make(map[address.Address]*types.Actor),
+	}, nil
+}
+
+// GetActor returns the actor at addr, or ErrActorNotFound if none exists.
+func (st *StateTree) GetActor(addr address.Address) (*types.Actor, error) {
+	if act, ok := st.actorcache[addr]; ok {
+		return act, nil
+	}
+
+	var act types.Actor
+	if err := st.root.Find(context.TODO(), string(addr.Bytes()), &act); err != nil {
+		if err == hamt.ErrNotFound {
+			return nil, ErrActorNotFound
+		}
+		return nil, err
+	}
+
+	st.actorcache[addr] = &act
+	return &act, nil
+}
+
+// SetActor registers act at addr, overwriting whatever was there before.
+// The change lands in the actor cache, where GetActor sees it at once; it
+// only reaches the underlying HAMT when Flush is called.
+func (st *StateTree) SetActor(addr address.Address, act *types.Actor) {
+	st.actorcache[addr] = act
+}
+
+// Snapshot pushes a checkpoint of every cached actor's current value onto
+// the snapshot stack.
+func (st *StateTree) Snapshot() {
+	snap := make(map[address.Address]types.Actor, len(st.actorcache))
+	for addr, act := range st.actorcache {
+		snap[addr] = *act
+	}
+	st.snapshots = append(st.snapshots, snap)
+}
+
+// Revert restores actor state to the top checkpoint and pops it off the
+// stack, undoing everything that happened since the matching Snapshot call
+// - including discarding any actor cached since then. An actor dropped from
+// the cache this way is simply re-read from the HAMT (unchanged) the next
+// time it's needed, since SetActor never touches the HAMT directly.
+func (st *StateTree) Revert() {
+	n := len(st.snapshots)
+	if n == 0 {
+		return
+	}
+	snap := st.snapshots[n-1]
+	st.snapshots = st.snapshots[:n-1]
+
+	for addr := range st.actorcache {
+		if _, ok := snap[addr]; !ok {
+			delete(st.actorcache, addr)
+		}
+	}
+	for addr, val := range snap {
+		v := val
+		if act, ok := st.actorcache[addr]; ok {
+			*act = v
+		} else {
+			st.actorcache[addr] = &v
+		}
+	}
+}
+
+// ClearSnapshot discards the top checkpoint without restoring it, once
+// whatever pushed it (e.g. a Send that ran to completion) no longer needs
+// to be able to revert to it.
+func (st *StateTree) ClearSnapshot() {
+	n := len(st.snapshots)
+	if n == 0 {
+		return
+	}
+	st.snapshots = st.snapshots[:n-1]
+}
+
+// ForEach calls fn once for every actor currently cached in the tree, in
+// unspecified order, stopping early if fn returns an error. Used by
+// VM.sumActorBalances to compute the total supply for the debugChecks
+// balance invariant.
+func (st *StateTree) ForEach(fn func(addr address.Address, act *types.Actor) error) error {
+	for addr, act := range st.actorcache {
+		if err := fn(addr, act); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Fork returns an independent StateTree that shares this one's underlying
+// HAMT (read-only until a Flush, which Fork callers never perform) but has
+// its own actor cache and snapshot stack, so it can be mutated - for a dry
+// run or a parallel batch overlay - without affecting st.
+func (st *StateTree) Fork() *StateTree {
+	cache := make(map[address.Address]*types.Actor, len(st.actorcache))
+	for addr, act := range st.actorcache {
+		v := *act
+		cache[addr] = &v
+	}
+
+	return &StateTree{
+		root:       st.root,
+		store:      st.store,
+		actorcache: cache,
+	}
+}
+
+// Merge copies every actor cached in other into st, overwriting whatever
+// was cached here under the same address. It's used to apply the result of
+// a successful parallel-batch overlay (built via Fork) back into the real
+// state tree.
+func (st *StateTree) Merge(other *StateTree) error {
+	for addr, act := range other.actorcache {
+		v := *act
+		st.actorcache[addr] = &v
+	}
+	return nil
+}
+
+// Flush writes every cached actor back into the underlying HAMT and returns
+// the resulting root cid.
+func (st *StateTree) Flush() (cid.Cid, error) {
+	for addr, act := range st.actorcache {
+		if err := st.root.Set(context.TODO(), string(addr.Bytes()), act); err != nil {
+			return cid.Undef, errors.Wrapf(err, "flushing actor %s", addr)
+		}
+	}
+
+	if err := st.root.Flush(context.TODO()); err != nil {
+		return cid.Undef, errors.Wrap(err, "flushing hamt node")
+	}
+
+	return st.store.Put(context.TODO(), st.root)
+}
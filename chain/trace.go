@@ -0,0 +1,86 @@
+package chain
+
+import (
+	"github.com/filecoin-project/go-lotus/chain/address"
+	"github.com/filecoin-project/go-lotus/chain/types"
+)
+
+// Tracer is notified of every low level event that occurs while a message
+// (and any sub-messages it triggers via Send) is executed. Block explorers,
+// replay debuggers and integration tests can use it to see exactly why an
+// actor call failed and how much gas each subcall consumed, none of which
+// is otherwise observable since Send swallows all intermediate state.
+type Tracer interface {
+	OnMessageEnter(msg *types.Message, depth int)
+	OnSend(to address.Address, method uint64)
+	OnGasCharge(charge GasCharge)
+	OnExit(exitCode byte)
+	OnRevert()
+}
+
+// ExecutionTrace is the recorded trace of a single ApplyMessage call,
+// including every nested Send it made. It's returned by
+// ApplyMessageWithTrace so callers can inspect an execution without having
+// to install their own Tracer.
+type ExecutionTrace struct {
+	Msg      *types.Message
+	ExitCode byte
+	Reverted bool
+
+	GasCharges []GasCharge
+	Subcalls   []*ExecutionTrace
+}
+
+// GasUsed sums the gas charged directly against this call, not counting
+// anything charged by its subcalls.
+func (et *ExecutionTrace) GasUsed() int64 {
+	var total int64
+	for _, c := range et.GasCharges {
+		total += c.Value
+	}
+	return total
+}
+
+// traceBuilder implements Tracer and assembles an ExecutionTrace tree as
+// execution proceeds. The top level ApplyMessage call enters depth 0, and
+// every Send pushes a child trace and descends into it.
+type traceBuilder struct {
+	root  *ExecutionTrace
+	stack []*ExecutionTrace
+}
+
+func newTraceBuilder() *traceBuilder {
+	return &traceBuilder{}
+}
+
+func (tb *traceBuilder) top() *ExecutionTrace {
+	return tb.stack[len(tb.stack)-1]
+}
+
+func (tb *traceBuilder) OnMessageEnter(msg *types.Message, depth int) {
+	et := &ExecutionTrace{Msg: msg}
+	if tb.root == nil {
+		tb.root = et
+	} else {
+		parent := tb.top()
+		parent.Subcalls = append(parent.Subcalls, et)
+	}
+	tb.stack = append(tb.stack, et)
+}
+
+func (tb *traceBuilder) OnSend(to address.Address, method uint64) {}
+
+func (tb *traceBuilder) OnGasCharge(charge GasCharge) {
+	cur := tb.top()
+	cur.GasCharges = append(cur.GasCharges, charge)
+}
+
+func (tb *traceBuilder) OnExit(exitCode byte) {
+	cur := tb.top()
+	cur.ExitCode = exitCode
+	tb.stack = tb.stack[:len(tb.stack)-1]
+}
+
+func (tb *traceBuilder) OnRevert() {
+	tb.top().Reverted = true
+}
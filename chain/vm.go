@@ -13,6 +13,7 @@ import (
 	bserv "github.com/ipfs/go-blockservice"
 	cid "github.com/ipfs/go-cid"
 	hamt "github.com/ipfs/go-hamt-ipld"
+	cbor "github.com/ipfs/go-ipld-cbor"
 	ipld "github.com/ipfs/go-ipld-format"
 	dag "github.com/ipfs/go-merkledag"
 	"github.com/pkg/errors"
@@ -29,6 +30,9 @@ type VMContext struct {
 	sroot cid.Cid
 
 	storage types.Storage
+
+	gas   *gasTracker
+	depth int
 }
 
 // Message is the message that kicked off the current invocation
@@ -41,14 +45,38 @@ type storage struct {
 	// I am my own worst enemy
 	cst  *hamt.CborIpldStore
 	head cid.Cid
+	// charge is the owning VMContext's chargeGas, so storage charges reach
+	// both the shared gas budget and any attached Tracer
+	charge func(name string, amount int64) error
 }
 
 func (s *storage) Put(i interface{}) (cid.Cid, error) {
+	data, err := cbor.DumpObject(i)
+	if err != nil {
+		return cid.Undef, err
+	}
+
+	if err := s.charge("OnStoragePut", GasStoragePutBase+GasStoragePutPerByte*int64(len(data))); err != nil {
+		return cid.Undef, err
+	}
+
 	return s.cst.Put(context.TODO(), i)
 }
 
 func (s *storage) Get(c cid.Cid, out interface{}) error {
-	return s.cst.Get(context.TODO(), c, out)
+	if err := s.charge("OnStorageGet", GasStorageGetBase+GasIpldLinkTraversal); err != nil {
+		return err
+	}
+
+	if err := s.cst.Get(context.TODO(), c, out); err != nil {
+		return err
+	}
+
+	if data, err := cbor.DumpObject(out); err == nil {
+		return s.charge("OnStorageGetBytes", GasStorageGetPerByte*int64(len(data)))
+	}
+
+	return nil
 }
 
 func (s *storage) GetHead() cid.Cid {
@@ -75,6 +103,10 @@ func (vmc *VMContext) Ipld() *hamt.CborIpldStore {
 
 // Send allows the current execution context to invoke methods on other actors in the system
 func (vmc *VMContext) Send(to address.Address, method uint64, value types.BigInt, params []byte) ([]byte, uint8, error) {
+	if err := vmc.chargeGas("OnMethodSend", GasSend); err != nil {
+		return nil, ExitCodeOutOfGas, nil
+	}
+
 	msg := &types.Message{
 		From:   vmc.msg.From,
 		To:     to,
@@ -83,30 +115,87 @@ func (vmc *VMContext) Send(to address.Address, method uint64, value types.BigInt
 		Params: params,
 	}
 
+	if vmc.vm.tracer != nil {
+		vmc.vm.tracer.OnSend(to, method)
+	}
+
 	toAct, err := vmc.state.GetActor(to)
 	if err != nil {
 		return nil, 0, err
 	}
 
-	nvmctx := vmc.vm.makeVMContext(toAct.Head, msg)
+	// push a snapshot for this subcall so a failure here only rolls back
+	// what it (and anything it sends to in turn) touched, not the whole
+	// top-level message
+	vmc.state.Snapshot()
+
+	if types.BigCmp(value, types.NewInt(0)) != 0 {
+		if err := vmc.vm.TransferFunds(vmc.msg.To, to, value); err != nil {
+			vmc.state.Revert()
+			return nil, 0, err
+		}
+	}
+
+	nvmctx := vmc.vm.makeVMContext(toAct.Head, msg, vmc.gas, vmc.depth+1)
 
 	res, ret, err := vmc.vm.Invoke(toAct, nvmctx, method, params)
 	if err != nil {
-		return nil, 0, err
+		if xerrors.Is(err, ErrOutOfGas) {
+			// same translation ApplyMessage does at the top level: gas
+			// exhaustion is a normal (non-zero exit code) outcome, not a
+			// Go error, and the caller/tracer need to see it as such
+			ret = ExitCodeOutOfGas
+			err = nil
+		} else {
+			// OnRevert must run before OnExit: OnExit pops this call's
+			// trace frame, so calling it first would leave OnRevert
+			// marking whatever frame is now on top (the caller's) instead
+			// of this one
+			if vmc.vm.tracer != nil {
+				vmc.vm.tracer.OnRevert()
+				vmc.vm.tracer.OnExit(0)
+			}
+			vmc.state.Revert()
+			return nil, 0, err
+		}
+	}
+
+	if ret != 0 {
+		if vmc.vm.tracer != nil {
+			vmc.vm.tracer.OnRevert()
+			vmc.vm.tracer.OnExit(ret)
+		}
+		vmc.state.Revert()
+		return nil, ret, nil
+	}
+
+	if vmc.vm.tracer != nil {
+		vmc.vm.tracer.OnExit(ret)
 	}
 
 	toAct.Head = nvmctx.Storage().GetHead()
+	vmc.state.ClearSnapshot()
 
 	return res, ret, err
 }
 
+// chargeGas deducts amount from the message's remaining gas budget. name
+// identifies the operation being charged for, which is only used by
+// whatever Tracer is attached to this call.
+func (vmc *VMContext) chargeGas(name string, amount int64) error {
+	if vmc.vm.tracer != nil {
+		vmc.vm.tracer.OnGasCharge(GasCharge{Name: name, Value: amount})
+	}
+	return vmc.gas.charge(amount)
+}
+
 // BlockHeight returns the height of the block this message was added to the chain in
 func (vmc *VMContext) BlockHeight() uint64 {
 	return vmc.height
 }
 
 func (vmc *VMContext) GasUsed() types.BigInt {
-	return types.NewInt(0)
+	return vmc.gas.used
 }
 
 func (vmc *VMContext) StateTree() (types.StateTree, error) {
@@ -117,21 +206,29 @@ func (vmc *VMContext) StateTree() (types.StateTree, error) {
 	return vmc.state, nil
 }
 
-func (vm *VM) makeVMContext(sroot cid.Cid, msg *types.Message) *VMContext {
+func (vm *VM) makeVMContext(sroot cid.Cid, msg *types.Message, gas *gasTracker, depth int) *VMContext {
 	cst := hamt.CSTFromBstore(vm.cs.bs)
 
-	return &VMContext{
+	if vm.tracer != nil {
+		vm.tracer.OnMessageEnter(msg, depth)
+	}
+
+	vmc := &VMContext{
 		vm:     vm,
 		state:  vm.cstate,
 		sroot:  sroot,
 		msg:    msg,
 		height: vm.blockHeight,
 		cst:    cst,
-		storage: &storage{
-			cst:  cst,
-			head: sroot,
-		},
+		gas:    gas,
+		depth:  depth,
+	}
+	vmc.storage = &storage{
+		cst:    cst,
+		head:   sroot,
+		charge: vmc.chargeGas,
 	}
+	return vmc
 }
 
 type VM struct {
@@ -142,6 +239,62 @@ type VM struct {
 	blockHeight uint64
 	blockMiner  address.Address
 	inv         *invoker
+
+	tracer Tracer
+
+	debugChecks bool
+}
+
+// SetTracer attaches a Tracer that will be notified of every message entry,
+// send, gas charge, exit and revert until it is replaced or cleared with a
+// nil argument. It's meant for tooling (block explorers, replay debuggers)
+// that wants a live feed of execution events rather than the post-hoc tree
+// ApplyMessageWithTrace returns.
+func (vm *VM) SetTracer(t Tracer) {
+	vm.tracer = t
+}
+
+// SetDebugChecks turns on expensive invariant checks (currently just the
+// actor balance conservation check) after every ApplyMessage and Flush.
+// Walking every cached actor on each call is far too slow for production
+// use, so this should only ever be set by tests and sync validation that
+// want to catch a broken invariant as soon as it happens.
+func (vm *VM) SetDebugChecks(enabled bool) {
+	vm.debugChecks = enabled
+}
+
+// sumActorBalances walks every actor currently in the state tree's actor
+// cache (see StateTree.ForEach) and returns the sum of their balances.
+// Actors that are only in the HAMT and have not been loaded are not counted.
+func (vm *VM) sumActorBalances() (types.BigInt, error) {
+	total := types.NewInt(0)
+	err := vm.cstate.ForEach(func(addr address.Address, act *types.Actor) error {
+		total = types.BigAdd(total, act.Balance)
+		return nil
+	})
+	if err != nil {
+		return types.BigInt{}, err
+	}
+
+	return total, nil
+}
+
+// CheckBalanceInvariant sums the balance of every cached actor (as
+// sumActorBalances does) and returns an error if it doesn't equal
+// expectedTotal. Conservation
+// should hold exactly across ApplyMessage, since gas fees are always moved
+// from the sender to the block miner rather than burned or minted.
+func (vm *VM) CheckBalanceInvariant(expectedTotal types.BigInt) error {
+	total, err := vm.sumActorBalances()
+	if err != nil {
+		return errors.Wrap(err, "summing actor balances")
+	}
+
+	if types.BigCmp(total, expectedTotal) != 0 {
+		return fmt.Errorf("balance invariant broken: expected %s, got %s", expectedTotal, total)
+	}
+
+	return nil
 }
 
 func NewVM(base cid.Cid, height uint64, maddr address.Address, cs *ChainStore) (*VM, error) {
@@ -164,6 +317,15 @@ func NewVM(base cid.Cid, height uint64, maddr address.Address, cs *ChainStore) (
 }
 
 func (vm *VM) ApplyMessage(msg *types.Message) (*types.MessageReceipt, error) {
+	var preTotal types.BigInt
+	if vm.debugChecks {
+		var err error
+		preTotal, err = vm.sumActorBalances()
+		if err != nil {
+			return nil, errors.Wrap(err, "summing actor balances before ApplyMessage")
+		}
+	}
+
 	st := vm.cstate
 	st.Snapshot()
 	fromActor, err := st.GetActor(msg.From)
@@ -200,14 +362,32 @@ func (vm *VM) ApplyMessage(msg *types.Message) (*types.MessageReceipt, error) {
 	}
 	DepositFunds(toActor, msg.Value)
 
-	vmctx := vm.makeVMContext(toActor.Head, msg)
+	vmctx := vm.makeVMContext(toActor.Head, msg, newGasTracker(msg.GasLimit), 0)
 
 	var errcode byte
 	var ret []byte
 	if msg.Method != 0 {
 		ret, errcode, err = vm.Invoke(toActor, vmctx, msg.Method, msg.Params)
 		if err != nil {
-			return nil, err
+			if xerrors.Is(err, ErrOutOfGas) {
+				errcode = ExitCodeOutOfGas
+			} else {
+				// st.Snapshot() above is still open - pop it before
+				// returning so it doesn't linger on cstate's stack for
+				// whatever message this long-lived VM applies next
+				st.Revert()
+				return nil, err
+			}
+		}
+
+		// OnRevert must run before OnExit: OnExit pops this message's trace
+		// frame (the only one left at the top level), so calling it first
+		// would leave OnRevert indexing an empty stack
+		if errcode != 0 && vm.tracer != nil {
+			vm.tracer.OnRevert()
+		}
+		if vm.tracer != nil {
+			vm.tracer.OnExit(errcode)
 		}
 
 		if errcode != 0 {
@@ -233,6 +413,14 @@ func (vm *VM) ApplyMessage(msg *types.Message) (*types.MessageReceipt, error) {
 	gasReward := types.BigMul(msg.GasPrice, vmctx.GasUsed())
 	DepositFunds(miner, gasReward)
 
+	if vm.debugChecks {
+		// gas fees only ever move from the sender to the miner, so the
+		// total across all actors should be exactly what it was before
+		if err := vm.CheckBalanceInvariant(preTotal); err != nil {
+			return nil, errors.Wrap(err, "balance invariant check failed after ApplyMessage")
+		}
+	}
+
 	return &types.MessageReceipt{
 		ExitCode: errcode,
 		Return:   ret,
@@ -240,7 +428,31 @@ func (vm *VM) ApplyMessage(msg *types.Message) (*types.MessageReceipt, error) {
 	}, nil
 }
 
+// ApplyMessageWithTrace behaves exactly like ApplyMessage, but additionally
+// returns the ExecutionTrace recorded for the message and everything it
+// sent to. Any Tracer already installed with SetTracer is bypassed for the
+// duration of this call and restored afterwards.
+func (vm *VM) ApplyMessageWithTrace(msg *types.Message) (*types.MessageReceipt, *ExecutionTrace, error) {
+	tb := newTraceBuilder()
+
+	prev := vm.tracer
+	vm.tracer = tb
+	defer func() { vm.tracer = prev }()
+
+	rec, err := vm.ApplyMessage(msg)
+	return rec, tb.root, err
+}
+
 func (vm *VM) Flush(ctx context.Context) (cid.Cid, error) {
+	var preTotal types.BigInt
+	if vm.debugChecks {
+		var err error
+		preTotal, err = vm.sumActorBalances()
+		if err != nil {
+			return cid.Undef, errors.Wrap(err, "summing actor balances before Flush")
+		}
+	}
+
 	from := dag.NewDAGService(bserv.New(vm.buf, nil))
 	to := dag.NewDAGService(bserv.New(vm.buf.Read(), nil))
 
@@ -253,6 +465,14 @@ func (vm *VM) Flush(ctx context.Context) (cid.Cid, error) {
 		return cid.Undef, xerrors.Errorf("copying tree: %w", err)
 	}
 
+	if vm.debugChecks {
+		// flushing only serializes the tree to the backing store, it
+		// shouldn't ever change balances
+		if err := vm.CheckBalanceInvariant(preTotal); err != nil {
+			return cid.Undef, errors.Wrap(err, "balance invariant check failed after Flush")
+		}
+	}
+
 	return root, nil
 }
 
@@ -298,7 +518,7 @@ func (vm *VM) TransferFunds(from, to address.Address, amt types.BigInt) error {
 		return err
 	}
 
-	toAct, err := vm.cstate.GetActor(from)
+	toAct, err := vm.cstate.GetActor(to)
 	if err != nil {
 		return err
 	}
@@ -312,6 +532,10 @@ func (vm *VM) TransferFunds(from, to address.Address, amt types.BigInt) error {
 }
 
 func (vm *VM) Invoke(act *types.Actor, vmctx *VMContext, method uint64, params []byte) ([]byte, byte, error) {
+	if err := vmctx.chargeGas("OnMethodInvoke", GasInvoke); err != nil {
+		return nil, ExitCodeOutOfGas, nil
+	}
+
 	ret, err := vm.inv.Invoke(act, vmctx, method, params)
 	if err != nil {
 		return nil, 0, err
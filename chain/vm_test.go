@@ -0,0 +1,98 @@
+package chain
+
+import (
+	"testing"
+
+	"github.com/filecoin-project/go-lotus/chain/address"
+	"github.com/filecoin-project/go-lotus/chain/types"
+)
+
+func mustIDAddress(t *testing.T, id uint64) address.Address {
+	t.Helper()
+	a, err := address.NewIDAddress(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestCheckBalanceInvariant(t *testing.T) {
+	st := newStateTree()
+	a1 := mustIDAddress(t, 1)
+	a2 := mustIDAddress(t, 2)
+
+	st.SetActor(a1, &types.Actor{Balance: types.NewInt(100)})
+	st.SetActor(a2, &types.Actor{Balance: types.NewInt(50)})
+
+	vm := &VM{cstate: st}
+
+	if err := vm.CheckBalanceInvariant(types.NewInt(150)); err != nil {
+		t.Fatalf("expected invariant to hold, got: %s", err)
+	}
+
+	if err := vm.CheckBalanceInvariant(types.NewInt(151)); err == nil {
+		t.Fatal("expected invariant check to fail against a mismatched total")
+	}
+}
+
+func TestCheckBalanceInvariantCatchesMintedFunds(t *testing.T) {
+	st := newStateTree()
+	a1 := mustIDAddress(t, 1)
+
+	st.SetActor(a1, &types.Actor{Balance: types.NewInt(100)})
+
+	vm := &VM{cstate: st, debugChecks: true}
+
+	preTotal, err := vm.sumActorBalances()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate a bug that mints value out of thin air between the pre and
+	// post balance snapshots
+	act, err := st.GetActor(a1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	act.Balance = types.NewInt(1000)
+
+	if err := vm.CheckBalanceInvariant(preTotal); err == nil {
+		t.Fatal("expected the balance invariant check to catch the minted funds")
+	}
+}
+
+func TestStateTreeSnapshotStackIsNested(t *testing.T) {
+	st := newStateTree()
+	a1 := mustIDAddress(t, 1)
+	st.SetActor(a1, &types.Actor{Balance: types.NewInt(100)})
+
+	// outer snapshot, as ApplyMessage takes before invoking the message
+	st.Snapshot()
+
+	act, err := st.GetActor(a1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	act.Balance = types.NewInt(90)
+
+	// nested snapshot, as a Send takes before invoking the callee
+	st.Snapshot()
+	act.Balance = types.NewInt(80)
+	st.ClearSnapshot()
+
+	if types.BigCmp(act.Balance, types.NewInt(80)) != 0 {
+		t.Fatalf("expected balance 80 after the nested send cleared its snapshot, got %s", act.Balance)
+	}
+
+	// the outer message now fails and reverts everything, including what
+	// the already-cleared nested send did
+	st.Revert()
+
+	act, err = st.GetActor(a1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if types.BigCmp(act.Balance, types.NewInt(100)) != 0 {
+		t.Fatalf("expected balance restored to 100, got %s", act.Balance)
+	}
+}